@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"strings"
+
+	_ "github.com/mattn/go-sqlite3"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+// totpCodeLength is the number of trailing digits of an OpenVPN password
+// treated as the TOTP passcode, per the auth_totp.sh convention this
+// subcommand follows.
+const totpCodeLength = 6
+
+// authVerifyOptions configures the auth-verify subcommand, which implements
+// the OpenVPN auth-user-pass-verify via-file/via-env contract.
+type authVerifyOptions struct {
+	DBPath       string
+	ViaFile      string
+	ViaEnv       bool
+	TOTPRequired bool
+}
+
+// registerAuthVerifyCommand wires the auth-verify subcommand into app, so
+// `ovpn-admin auth-verify` can be dropped into a `script-security 2`
+// auth-user-pass-verify directive.
+func registerAuthVerifyCommand(app *kingpin.Application) {
+	opts := authVerifyOptions{}
+	cmd := app.Command("auth-verify", "Validate OpenVPN username/password (+ TOTP) via auth-user-pass-verify.")
+	cmd.Flag("db", "Path to the users sqlite database.").Required().StringVar(&opts.DBPath)
+	cmd.Flag("via-file", "Path to the credentials file OpenVPN wrote (auth-user-pass-verify via-file).").StringVar(&opts.ViaFile)
+	cmd.Flag("via-env", "Read credentials from the username/password environment variables instead of via-file.").BoolVar(&opts.ViaEnv)
+	cmd.Flag("totp-required", "Reject users who do not have an enabled TOTP secret.").BoolVar(&opts.TOTPRequired)
+
+	cmd.Action(func(*kingpin.ParseContext) error {
+		if err := runAuthVerify(opts); err != nil {
+			log.WithError(err).Warn("auth-verify rejected login")
+			os.Exit(1)
+		}
+		os.Exit(0)
+		return nil
+	})
+}
+
+// runAuthVerify reads the username/password OpenVPN handed off, checks the
+// bcrypt password hash, and - when the user has TOTP enabled - validates
+// the trailing totpCodeLength digits of the password as a TOTP passcode.
+// It returns nil only when the user is fully authenticated.
+func runAuthVerify(opts authVerifyOptions) error {
+	username, password, err := readAuthCredentials(opts)
+	if err != nil {
+		return fmt.Errorf("reading credentials: %w", err)
+	}
+
+	passwordHash, err := getUserPasswordHash(opts.DBPath, username)
+	if err != nil {
+		return fmt.Errorf("looking up user %q: %w", username, err)
+	}
+	if passwordHash == "" {
+		return fmt.Errorf("unknown user %q", username)
+	}
+
+	store, err := NewTOTPStore(opts.DBPath)
+	if err != nil {
+		return fmt.Errorf("opening TOTP store: %w", err)
+	}
+	defer store.Close()
+
+	ctx := context.Background()
+
+	secret, err := store.getTOTPSecret(ctx, username)
+	if err != nil {
+		return fmt.Errorf("looking up TOTP secret for %q: %w", username, err)
+	}
+
+	// Only split off a trailing TOTP passcode once we know the user actually
+	// has one enabled - otherwise this truncates a normal user's real
+	// password before it ever reaches bcrypt.
+	passcode := ""
+	if secret != nil && secret.Enabled && len(password) > totpCodeLength {
+		passcode = password[len(password)-totpCodeLength:]
+		password = password[:len(password)-totpCodeLength]
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(passwordHash), []byte(password)); err != nil {
+		return fmt.Errorf("invalid password for user %q", username)
+	}
+
+	switch {
+	case secret != nil && secret.Enabled:
+		ok, err := store.verifyTOTP(ctx, secret, passcode)
+		if err != nil {
+			return fmt.Errorf("verifying TOTP passcode for %q: %w", username, err)
+		}
+		if !ok {
+			ok, err = store.VerifyRecoveryCode(ctx, username, passcode)
+			if err != nil {
+				return fmt.Errorf("verifying TOTP recovery code for %q: %w", username, err)
+			}
+		}
+		if !ok {
+			return fmt.Errorf("invalid TOTP passcode for user %q", username)
+		}
+	case opts.TOTPRequired:
+		return fmt.Errorf("TOTP is required but not enabled for user %q", username)
+	}
+
+	return nil
+}
+
+// readAuthCredentials reads "username\npassword\n" either from the via-file
+// path OpenVPN wrote, or from the username/password environment variables
+// it sets when auth-user-pass-verify uses the via-env method.
+func readAuthCredentials(opts authVerifyOptions) (string, string, error) {
+	if opts.ViaEnv {
+		username := os.Getenv("username")
+		password := os.Getenv("password")
+		if username == "" || password == "" {
+			return "", "", fmt.Errorf("username/password environment variables not set")
+		}
+		return username, password, nil
+	}
+
+	if opts.ViaFile == "" {
+		return "", "", fmt.Errorf("no via-file path provided")
+	}
+
+	f, err := os.Open(opts.ViaFile)
+	if err != nil {
+		return "", "", err
+	}
+	defer f.Close()
+
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		return "", "", err
+	}
+	if len(lines) < 2 {
+		return "", "", fmt.Errorf("via-file %q did not contain a username and password line", opts.ViaFile)
+	}
+
+	return strings.TrimSpace(lines[0]), lines[1], nil
+}
+
+// getUserPasswordHash returns the bcrypt password hash stored for username,
+// or "" if the user does not exist.
+func getUserPasswordHash(dbPath, username string) (string, error) {
+	db, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		return "", err
+	}
+	defer db.Close()
+
+	var hash string
+	err = db.QueryRow("SELECT password_hash FROM users WHERE username = ?", username).Scan(&hash)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return "", nil
+		}
+		return "", err
+	}
+
+	return hash, nil
+}
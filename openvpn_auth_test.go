@@ -0,0 +1,93 @@
+package main
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// newAuthVerifyTestDB creates a fresh sqlite database with a users table and
+// TOTP tables, then stores username with passwordHash.
+func newAuthVerifyTestDB(t *testing.T, username, passwordHash string) string {
+	t.Helper()
+
+	dbPath := filepath.Join(t.TempDir(), "users.db")
+
+	db, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		t.Fatalf("opening test db: %v", err)
+	}
+	defer db.Close()
+
+	if _, err := db.Exec("CREATE TABLE users (username TEXT PRIMARY KEY, password_hash TEXT NOT NULL)"); err != nil {
+		t.Fatalf("creating users table: %v", err)
+	}
+	if _, err := db.Exec("INSERT INTO users(username, password_hash) VALUES(?, ?)", username, passwordHash); err != nil {
+		t.Fatalf("inserting user: %v", err)
+	}
+
+	if err := initTOTPDBForTest(dbPath); err != nil {
+		t.Fatalf("initializing TOTP tables: %v", err)
+	}
+
+	return dbPath
+}
+
+// initTOTPDBForTest creates the TOTP tables via a throwaway store, mirroring
+// what ovpn-admin does on startup.
+func initTOTPDBForTest(dbPath string) error {
+	store, err := NewTOTPStore(dbPath)
+	if err != nil {
+		return err
+	}
+	return store.Close()
+}
+
+func TestRunAuthVerify_PlainPasswordLongerThanTOTPCodeLength(t *testing.T) {
+	const username = "alice"
+	const password = "a-long-password-without-2fa"
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("hashing password: %v", err)
+	}
+
+	dbPath := newAuthVerifyTestDB(t, username, string(hash))
+
+	t.Setenv("username", username)
+	t.Setenv("password", password)
+
+	err = runAuthVerify(authVerifyOptions{
+		DBPath: dbPath,
+		ViaEnv: true,
+	})
+	if err != nil {
+		t.Fatalf("expected plain password login to succeed for a user without TOTP enabled, got: %v", err)
+	}
+}
+
+func TestRunAuthVerify_RejectsWrongPassword(t *testing.T) {
+	const username = "alice"
+	const password = "a-long-password-without-2fa"
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("hashing password: %v", err)
+	}
+
+	dbPath := newAuthVerifyTestDB(t, username, string(hash))
+
+	t.Setenv("username", username)
+	t.Setenv("password", "totally-wrong-password")
+
+	err = runAuthVerify(authVerifyOptions{
+		DBPath: dbPath,
+		ViaEnv: true,
+	})
+	if err == nil {
+		t.Fatal("expected wrong password to be rejected")
+	}
+}
@@ -2,9 +2,13 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"database/sql"
 	"encoding/base64"
+	"errors"
+	"fmt"
 	"image/png"
+	"time"
 
 	"github.com/pquerna/otp"
 	"github.com/pquerna/otp/totp"
@@ -12,18 +16,181 @@ import (
 	_ "github.com/mattn/go-sqlite3"
 )
 
-// TOTPSecret represents a user's TOTP secret
+// TOTPSecret represents a user's TOTP secret, its enrollment parameters,
+// and its replay counter.
 type TOTPSecret struct {
-	Username string
-	Secret   string
+	Username        string
+	Secret          string
+	URL             string
+	Enabled         bool
+	Period          uint
+	Digits          otp.Digits
+	Algorithm       otp.Algorithm
+	LastUsedCounter int64
+}
+
+// TOTPStatus reports the enrollment state of a user's second factor.
+type TOTPStatus struct {
+	Enrolled bool
 	Enabled  bool
+	URL      string
+}
+
+// TOTPStore holds a pooled connection to the users database plus prepared
+// statements for the hot paths hit on every OpenVPN auth attempt.
+type TOTPStore struct {
+	db *sql.DB
+
+	getSecretStmt     *sql.Stmt
+	updateCounterStmt *sql.Stmt
+}
+
+// NewTOTPStore opens dbPath once, applies the TOTP schema migrations, and
+// prepares the store's hot-path statements.
+func NewTOTPStore(dbPath string) (*TOTPStore, error) {
+	db, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		return nil, err
+	}
+
+	db.SetMaxOpenConns(8)
+	db.SetMaxIdleConns(8)
+
+	if _, err := db.Exec("PRAGMA journal_mode=WAL"); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	store := &TOTPStore{db: db}
+
+	if err := store.migrateSchema(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	if err := store.prepareStatements(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return store, nil
+}
+
+// Close releases the store's pooled connection and prepared statements.
+func (s *TOTPStore) Close() error {
+	return s.db.Close()
+}
+
+// prepareStatements prepares the statements used on every TOTP verification.
+func (s *TOTPStore) prepareStatements() error {
+	var err error
+
+	s.getSecretStmt, err = s.db.Prepare(
+		"SELECT username, secret, url, enabled, period, digits, algorithm, last_used_counter FROM totp_secrets WHERE username = ?")
+	if err != nil {
+		return err
+	}
+
+	s.updateCounterStmt, err = s.db.Prepare("UPDATE totp_secrets SET last_used_counter = ? WHERE username = ?")
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// migrateSchema creates the TOTP tables if they don't exist yet and
+// back-fills columns added by later schema versions.
+func (s *TOTPStore) migrateSchema() error {
+	createTableSQL := `CREATE TABLE IF NOT EXISTS totp_secrets (
+		username TEXT PRIMARY KEY,
+		secret TEXT NOT NULL,
+		url TEXT NOT NULL DEFAULT '',
+		enabled INTEGER NOT NULL DEFAULT 0,
+		last_used_counter INTEGER NOT NULL DEFAULT 0,
+		period INTEGER NOT NULL DEFAULT 30,
+		digits INTEGER NOT NULL DEFAULT 6,
+		algorithm TEXT NOT NULL DEFAULT 'SHA1'
+	);`
+
+	if _, err := s.db.Exec(createTableSQL); err != nil {
+		return err
+	}
+
+	if err := migrateTOTPSecretsColumns(s.db); err != nil {
+		return err
+	}
+
+	createRecoveryCodesTableSQL := `CREATE TABLE IF NOT EXISTS totp_recovery_codes (
+		username TEXT NOT NULL,
+		code_hash TEXT NOT NULL,
+		used_at INTEGER
+	);`
+
+	if _, err := s.db.Exec(createRecoveryCodesTableSQL); err != nil {
+		return err
+	}
+
+	log.Debug("TOTP tables initialized in users database")
+	return nil
+}
+
+// migrateTOTPSecretsColumns adds columns introduced after the initial
+// totp_secrets table to an already-existing table that predates them.
+func migrateTOTPSecretsColumns(db *sql.DB) error {
+	rows, err := db.Query("PRAGMA table_info(totp_secrets)")
+	if err != nil {
+		return err
+	}
+	existing := map[string]bool{}
+	for rows.Next() {
+		var cid int
+		var name, colType string
+		var notNull, pk int
+		var dflt sql.NullString
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &dflt, &pk); err != nil {
+			rows.Close()
+			return err
+		}
+		existing[name] = true
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	migrations := []struct {
+		column string
+		ddl    string
+	}{
+		{"period", "ALTER TABLE totp_secrets ADD COLUMN period INTEGER NOT NULL DEFAULT 30"},
+		{"digits", "ALTER TABLE totp_secrets ADD COLUMN digits INTEGER NOT NULL DEFAULT 6"},
+		{"algorithm", "ALTER TABLE totp_secrets ADD COLUMN algorithm TEXT NOT NULL DEFAULT 'SHA1'"},
+		{"last_used_counter", "ALTER TABLE totp_secrets ADD COLUMN last_used_counter INTEGER NOT NULL DEFAULT 0"},
+	}
+	for _, m := range migrations {
+		if existing[m.column] {
+			continue
+		}
+		if _, err := db.Exec(m.ddl); err != nil {
+			return err
+		}
+		log.WithField("column", m.column).Info("backfilled totp_secrets column")
+	}
+
+	return nil
 }
 
-// generateTOTPSecret generates a new TOTP secret for a user
+// generateTOTPSecret generates a new TOTP secret for a user using the
+// process-wide TOTPConfig.
 func generateTOTPSecret(username string) (*otp.Key, error) {
 	key, err := totp.Generate(totp.GenerateOpts{
-		Issuer:      "ovpn-admin",
+		Issuer:      totpConfig.Issuer,
 		AccountName: username,
+		Period:      uint(totpConfig.Period),
+		Digits:      totpConfig.Digits,
+		Algorithm:   totpConfig.Algorithm,
+		SecretSize:  totpConfig.SecretSize,
 	})
 	if err != nil {
 		return nil, err
@@ -38,80 +205,74 @@ func generateTOTPQRCode(key *otp.Key) (string, error) {
 	if err != nil {
 		return "", err
 	}
-	
+
 	err = png.Encode(&buf, img)
 	if err != nil {
 		return "", err
 	}
-	
+
 	// Return base64 encoded PNG
 	return base64.StdEncoding.EncodeToString(buf.Bytes()), nil
 }
 
-// verifyTOTP verifies a TOTP code for a given secret
-func verifyTOTP(secret, code string) bool {
-	return totp.Validate(code, secret)
-}
-
-// initTOTPDB initializes the TOTP database table in the users database
-func initTOTPDB(dbPath string) error {
-	db, err := sql.Open("sqlite3", dbPath)
+// verifyTOTP verifies a passcode against secret's own enrolled
+// period/digits/algorithm and, on success, advances the replay counter.
+func (s *TOTPStore) verifyTOTP(ctx context.Context, secret *TOTPSecret, code string) (bool, error) {
+	valid, err := totp.ValidateCustom(code, secret.Secret, time.Now(), totp.ValidateOpts{
+		Period:    secret.Period,
+		Skew:      totpConfig.Skew,
+		Digits:    secret.Digits,
+		Algorithm: secret.Algorithm,
+	})
 	if err != nil {
-		return err
+		return false, err
+	}
+	if !valid {
+		return false, nil
 	}
-	defer db.Close()
 
-	createTableSQL := `CREATE TABLE IF NOT EXISTS totp_secrets (
-		username TEXT PRIMARY KEY,
-		secret TEXT NOT NULL,
-		enabled INTEGER NOT NULL DEFAULT 0
-	);`
+	counter := time.Now().Unix() / int64(secret.Period)
+	if counter <= secret.LastUsedCounter {
+		log.WithField("username", secret.Username).Warn("rejected replayed TOTP code")
+		return false, nil
+	}
 
-	_, err = db.Exec(createTableSQL)
-	if err != nil {
-		return err
+	if _, err := s.updateCounterStmt.ExecContext(ctx, counter, secret.Username); err != nil {
+		return false, err
 	}
 
-	log.Debug("TOTP table initialized in users database")
-	return nil
+	return true, nil
 }
 
-// saveTOTPSecret saves a TOTP secret for a user
-func saveTOTPSecret(dbPath, username, secret string, enabled bool) error {
-	db, err := sql.Open("sqlite3", dbPath)
-	if err != nil {
-		return err
-	}
-	defer db.Close()
-
+// saveTOTPSecret saves a TOTP secret for a user, along with the
+// period/digits/algorithm it was enrolled with.
+func (s *TOTPStore) saveTOTPSecret(ctx context.Context, username, secret, url string, enabled bool, period uint, digits otp.Digits, algorithm otp.Algorithm) error {
 	enabledInt := 0
 	if enabled {
 		enabledInt = 1
 	}
 
-	stmt, err := db.Prepare("INSERT OR REPLACE INTO totp_secrets(username, secret, enabled) VALUES(?, ?, ?)")
+	storedSecret, err := encryptTOTPSecret(secret)
 	if err != nil {
 		return err
 	}
-	defer stmt.Close()
 
-	_, err = stmt.Exec(username, secret, enabledInt)
+	_, err = s.db.ExecContext(ctx,
+		"INSERT OR REPLACE INTO totp_secrets(username, secret, url, enabled, period, digits, algorithm) VALUES(?, ?, ?, ?, ?, ?, ?)",
+		username, storedSecret, url, enabledInt, period, digits.Length(), totpAlgorithmToString(algorithm))
 	return err
 }
 
-// getTOTPSecret retrieves the TOTP secret for a user
-func getTOTPSecret(dbPath, username string) (*TOTPSecret, error) {
-	db, err := sql.Open("sqlite3", dbPath)
-	if err != nil {
-		return nil, err
-	}
-	defer db.Close()
+// getTOTPSecret retrieves the TOTP secret for a user using the store's
+// prepared statement.
+func (s *TOTPStore) getTOTPSecret(ctx context.Context, username string) (*TOTPSecret, error) {
+	row := s.getSecretStmt.QueryRowContext(ctx, username)
 
-	row := db.QueryRow("SELECT username, secret, enabled FROM totp_secrets WHERE username = ?", username)
-	
 	var totpSecret TOTPSecret
 	var enabledInt int
-	err = row.Scan(&totpSecret.Username, &totpSecret.Secret, &enabledInt)
+	var period, digits uint
+	var algorithm string
+	err := row.Scan(&totpSecret.Username, &totpSecret.Secret, &totpSecret.URL, &enabledInt, &period, &digits, &algorithm, &totpSecret.LastUsedCounter)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return nil, nil // No TOTP secret found
@@ -119,60 +280,139 @@ func getTOTPSecret(dbPath, username string) (*TOTPSecret, error) {
 		return nil, err
 	}
 
+	totpSecret.Secret, err = decryptTOTPSecret(totpSecret.Secret)
+	if err != nil {
+		return nil, err
+	}
+
 	totpSecret.Enabled = enabledInt == 1
+	totpSecret.Period = period
+
+	totpSecret.Digits, err = totpDigitsFromUint(digits)
+	if err != nil {
+		return nil, err
+	}
+
+	totpSecret.Algorithm, err = totpAlgorithmFromString(algorithm)
+	if err != nil {
+		return nil, err
+	}
+
 	return &totpSecret, nil
 }
 
 // deleteTOTPSecret deletes the TOTP secret for a user
-func deleteTOTPSecret(dbPath, username string) error {
-	db, err := sql.Open("sqlite3", dbPath)
+func (s *TOTPStore) deleteTOTPSecret(ctx context.Context, username string) error {
+	_, err := s.db.ExecContext(ctx, "DELETE FROM totp_secrets WHERE username = ?", username)
+	return err
+}
+
+// enableTOTP enables TOTP for a user
+func (s *TOTPStore) enableTOTP(ctx context.Context, username string) error {
+	_, err := s.db.ExecContext(ctx, "UPDATE totp_secrets SET enabled = 1 WHERE username = ?", username)
+	return err
+}
+
+// ErrTOTPAlreadyEnabled is returned by EnrollTOTP when the user already has
+// an enabled TOTP secret and must go through DisableTOTP first.
+var ErrTOTPAlreadyEnabled = errors.New("TOTP is already enabled; disable it before re-enrolling")
+
+// EnrollTOTP begins enrollment for a user: it generates a fresh secret,
+// stores it disabled, and returns the base32 secret, the otpauth:// URL, a
+// QR code PNG, and a fresh batch of recovery codes. TOTP stays disabled
+// until ConfirmTOTP proves the app produced a matching code. It refuses
+// with ErrTOTPAlreadyEnabled if the user already has TOTP enabled.
+func (s *TOTPStore) EnrollTOTP(ctx context.Context, username string) (secret, url, qrCodePNGBase64 string, recoveryCodes []string, err error) {
+	existing, err := s.getTOTPSecret(ctx, username)
 	if err != nil {
-		return err
+		return "", "", "", nil, err
+	}
+	if existing != nil && existing.Enabled {
+		return "", "", "", nil, ErrTOTPAlreadyEnabled
 	}
-	defer db.Close()
 
-	stmt, err := db.Prepare("DELETE FROM totp_secrets WHERE username = ?")
+	key, err := generateTOTPSecret(username)
 	if err != nil {
-		return err
+		return "", "", "", nil, err
 	}
-	defer stmt.Close()
 
-	_, err = stmt.Exec(username)
-	return err
+	qrCode, err := generateTOTPQRCode(key)
+	if err != nil {
+		return "", "", "", nil, err
+	}
+
+	if err := s.saveTOTPSecret(ctx, username, key.Secret(), key.String(), false, totpConfig.Period, totpConfig.Digits, totpConfig.Algorithm); err != nil {
+		return "", "", "", nil, err
+	}
+
+	recoveryCodes, err = s.RegenerateRecoveryCodes(ctx, username)
+	if err != nil {
+		return "", "", "", nil, err
+	}
+
+	return key.Secret(), key.String(), qrCode, recoveryCodes, nil
 }
 
-// enableTOTP enables TOTP for a user
-func enableTOTP(dbPath, username string) error {
-	db, err := sql.Open("sqlite3", dbPath)
+// ConfirmTOTP verifies passcode against the pending secret for username
+// and, only on success, flips it to enabled.
+func (s *TOTPStore) ConfirmTOTP(ctx context.Context, username, passcode string) error {
+	secret, err := s.getTOTPSecret(ctx, username)
 	if err != nil {
 		return err
 	}
-	defer db.Close()
-
-	stmt, err := db.Prepare("UPDATE totp_secrets SET enabled = 1 WHERE username = ?")
+	if secret == nil {
+		return fmt.Errorf("no TOTP secret enrolled for user %q", username)
+	}
+	if secret.Enabled {
+		return fmt.Errorf("TOTP is already enabled for user %q", username)
+	}
+	ok, err := s.verifyTOTP(ctx, secret, passcode)
 	if err != nil {
 		return err
 	}
-	defer stmt.Close()
+	if !ok {
+		return fmt.Errorf("invalid TOTP passcode for user %q", username)
+	}
 
-	_, err = stmt.Exec(username)
-	return err
+	return s.enableTOTP(ctx, username)
 }
 
-// disableTOTP disables TOTP for a user
-func disableTOTP(dbPath, username string) error {
-	db, err := sql.Open("sqlite3", dbPath)
+// DisableTOTP removes a user's TOTP secret after verifying a current
+// passcode.
+func (s *TOTPStore) DisableTOTP(ctx context.Context, username, passcode string) error {
+	secret, err := s.getTOTPSecret(ctx, username)
 	if err != nil {
 		return err
 	}
-	defer db.Close()
-
-	stmt, err := db.Prepare("UPDATE totp_secrets SET enabled = 0 WHERE username = ?")
+	if secret == nil || !secret.Enabled {
+		return fmt.Errorf("TOTP is not enabled for user %q", username)
+	}
+	ok, err := s.verifyTOTP(ctx, secret, passcode)
 	if err != nil {
 		return err
 	}
-	defer stmt.Close()
+	if !ok {
+		return fmt.Errorf("invalid TOTP passcode for user %q", username)
+	}
 
-	_, err = stmt.Exec(username)
-	return err
+	return s.deleteTOTPSecret(ctx, username)
+}
+
+// GetTOTPStatus reports whether username has enrolled TOTP and whether it
+// is enabled. The otpauth:// URL is only included while enrollment is
+// pending.
+func (s *TOTPStore) GetTOTPStatus(ctx context.Context, username string) (*TOTPStatus, error) {
+	secret, err := s.getTOTPSecret(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	if secret == nil {
+		return &TOTPStatus{}, nil
+	}
+
+	status := &TOTPStatus{Enrolled: true, Enabled: secret.Enabled}
+	if !secret.Enabled {
+		status.URL = secret.URL
+	}
+	return status, nil
 }
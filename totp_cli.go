@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+// registerTOTPCommands wires the `ovpn-admin totp ...` command group into
+// app: secret-storage maintenance (rekey) and user-facing self-service
+// (regenerate-recovery-codes) that an admin can run on a user's behalf.
+func registerTOTPCommands(app *kingpin.Application) {
+	totpCmd := app.Command("totp", "Manage TOTP secrets and recovery codes.")
+	registerTOTPRekeyCommand(totpCmd)
+	registerTOTPRegenerateRecoveryCodesCommand(totpCmd)
+}
+
+// registerTOTPRegenerateRecoveryCodesCommand wires
+// `ovpn-admin totp regenerate-recovery-codes` into totpCmd, printing a
+// fresh batch of recovery codes for a user.
+func registerTOTPRegenerateRecoveryCodesCommand(totpCmd *kingpin.CmdClause) {
+	var dbPath, username string
+
+	cmd := totpCmd.Command("regenerate-recovery-codes", "Replace a user's TOTP recovery codes and print the new ones.")
+	cmd.Flag("db", "Path to the users sqlite database.").Required().StringVar(&dbPath)
+	cmd.Flag("user", "Username to regenerate recovery codes for.").Required().StringVar(&username)
+
+	cmd.Action(func(*kingpin.ParseContext) error {
+		store, err := NewTOTPStore(dbPath)
+		if err != nil {
+			return err
+		}
+		defer store.Close()
+
+		codes, err := store.RegenerateRecoveryCodes(context.Background(), username)
+		if err != nil {
+			return err
+		}
+		for _, code := range codes {
+			fmt.Println(code)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/pquerna/otp"
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+// TOTPConfig holds the parameters used when enrolling new TOTP secrets.
+type TOTPConfig struct {
+	Issuer     string
+	Period     uint
+	Digits     otp.Digits
+	Algorithm  otp.Algorithm
+	SecretSize uint
+	Skew       uint
+}
+
+// defaultTOTPConfig matches the parameters this package has always used.
+var defaultTOTPConfig = TOTPConfig{
+	Issuer:     "ovpn-admin",
+	Period:     30,
+	Digits:     otp.DigitsSix,
+	Algorithm:  otp.AlgorithmSHA1,
+	SecretSize: 20,
+	Skew:       1,
+}
+
+// totpConfig is the process-wide configuration applied to new enrollments.
+var totpConfig = defaultTOTPConfig
+
+// SetTOTPConfig installs cfg as the configuration used for new TOTP
+// enrollments.
+func SetTOTPConfig(cfg TOTPConfig) {
+	totpConfig = cfg
+}
+
+// RegisterTOTPConfigFlags registers the --totp-issuer, --totp-period,
+// --totp-digits, --totp-algorithm, --totp-secret-size and --totp-skew
+// flags on app, and returns a function that must be called after
+// app.Parse() to validate and install them as the active TOTPConfig.
+func RegisterTOTPConfigFlags(app *kingpin.Application) func() error {
+	cfg := defaultTOTPConfig
+	var digits uint
+	var algorithm string
+
+	app.Flag("totp-issuer", "Issuer name shown in enrolled authenticator apps.").Default(cfg.Issuer).StringVar(&cfg.Issuer)
+	app.Flag("totp-period", "TOTP time-step in seconds.").Default("30").UintVar(&cfg.Period)
+	app.Flag("totp-digits", "Number of digits in a TOTP passcode (6 or 8).").Default("6").UintVar(&digits)
+	app.Flag("totp-algorithm", "TOTP HMAC algorithm: SHA1, SHA256, or SHA512.").Default("SHA1").StringVar(&algorithm)
+	app.Flag("totp-secret-size", "Size in bytes of newly generated TOTP secrets.").Default("20").UintVar(&cfg.SecretSize)
+	app.Flag("totp-skew", "Number of time-steps of clock skew to tolerate on either side.").Default("1").UintVar(&cfg.Skew)
+
+	return func() error {
+		d, err := totpDigitsFromUint(digits)
+		if err != nil {
+			return err
+		}
+		cfg.Digits = d
+
+		a, err := totpAlgorithmFromString(algorithm)
+		if err != nil {
+			return err
+		}
+		cfg.Algorithm = a
+
+		SetTOTPConfig(cfg)
+		return nil
+	}
+}
+
+// totpDigitsFromUint maps the --totp-digits flag value to an otp.Digits.
+func totpDigitsFromUint(digits uint) (otp.Digits, error) {
+	switch digits {
+	case 6:
+		return otp.DigitsSix, nil
+	case 8:
+		return otp.DigitsEight, nil
+	default:
+		return 0, fmt.Errorf("totp-digits must be 6 or 8, got %d", digits)
+	}
+}
+
+// totpAlgorithmFromString maps the --totp-algorithm flag value to an
+// otp.Algorithm.
+func totpAlgorithmFromString(algorithm string) (otp.Algorithm, error) {
+	switch algorithm {
+	case "SHA1":
+		return otp.AlgorithmSHA1, nil
+	case "SHA256":
+		return otp.AlgorithmSHA256, nil
+	case "SHA512":
+		return otp.AlgorithmSHA512, nil
+	default:
+		return 0, fmt.Errorf("totp-algorithm must be SHA1, SHA256, or SHA512, got %q", algorithm)
+	}
+}
+
+// totpAlgorithmToString is the inverse of totpAlgorithmFromString, used to
+// persist a user's algorithm alongside their secret.
+func totpAlgorithmToString(algorithm otp.Algorithm) string {
+	switch algorithm {
+	case otp.AlgorithmSHA256:
+		return "SHA256"
+	case otp.AlgorithmSHA512:
+		return "SHA512"
+	default:
+		return "SHA1"
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+
+	_ "github.com/mattn/go-sqlite3"
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+// totpEncryptionKeyEnv is the environment variable fallback for
+// --totp-encryption-key, for operators who would rather not pass secrets
+// on the command line.
+const totpEncryptionKeyEnv = "OVPN_ADMIN_TOTP_KEY"
+
+// totpEncryptionOptOut is the documented --totp-encryption-key value that
+// disables at-rest encryption, for migrating an existing deployment.
+const totpEncryptionOptOut = "none"
+
+// totpEncryptionKey is the operator-supplied master key used to encrypt
+// TOTP secrets at rest. Nil means encryption is not configured.
+var totpEncryptionKey []byte
+
+// SetTOTPEncryptionKey installs the master key used by encryptTOTPSecret
+// and decryptTOTPSecret. Pass nil to store secrets in plaintext.
+func SetTOTPEncryptionKey(key []byte) {
+	totpEncryptionKey = key
+}
+
+// LoadTOTPEncryptionKeyFlag resolves the --totp-encryption-key flag value
+// (falling back to the OVPN_ADMIN_TOTP_KEY environment variable when the
+// flag is empty) into a 32-byte AES-256 key. It returns optOut=true when
+// the operator explicitly disabled encryption.
+func LoadTOTPEncryptionKeyFlag(flagValue string) (key []byte, optOut bool, err error) {
+	if flagValue == totpEncryptionOptOut {
+		return nil, true, nil
+	}
+
+	raw := flagValue
+	if raw == "" {
+		raw = os.Getenv(totpEncryptionKeyEnv)
+	}
+	if raw == "" {
+		return nil, false, nil
+	}
+
+	key, err = base64.StdEncoding.DecodeString(raw)
+	if err != nil {
+		return nil, false, fmt.Errorf("totp encryption key must be base64: %w", err)
+	}
+	if len(key) != 32 {
+		return nil, false, fmt.Errorf("totp encryption key must decode to 32 bytes, got %d", len(key))
+	}
+
+	return key, false, nil
+}
+
+// CheckTOTPEncryptionConfigured refuses to start when totp_secrets already
+// holds rows but no encryption key (and no explicit opt-out) was configured.
+func CheckTOTPEncryptionConfigured(dbPath string, keyConfigured, optOut bool) error {
+	if keyConfigured || optOut {
+		return nil
+	}
+
+	db, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM totp_secrets").Scan(&count); err != nil {
+		return err
+	}
+	if count > 0 {
+		return fmt.Errorf("totp_secrets is non-empty but no --totp-encryption-key is configured; " +
+			"set one, or pass --totp-encryption-key=none to explicitly opt out during migration")
+	}
+
+	return nil
+}
+
+// encryptTOTPSecret envelopes secret as base64(nonce||ciphertext) using
+// AES-GCM, or returns it unchanged if no encryption key is configured.
+func encryptTOTPSecret(secret string) (string, error) {
+	if totpEncryptionKey == nil {
+		return secret, nil
+	}
+
+	block, err := aes.NewCipher(totpEncryptionKey)
+	if err != nil {
+		return "", err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+
+	sealed := gcm.Seal(nonce, nonce, []byte(secret), nil)
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// decryptTOTPSecret reverses encryptTOTPSecret, or returns stored unchanged
+// if no encryption key is configured.
+func decryptTOTPSecret(stored string) (string, error) {
+	if totpEncryptionKey == nil {
+		return stored, nil
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(stored)
+	if err != nil {
+		return "", fmt.Errorf("decoding encrypted totp secret: %w", err)
+	}
+
+	block, err := aes.NewCipher(totpEncryptionKey)
+	if err != nil {
+		return "", err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", err
+	}
+
+	nonceSize := gcm.NonceSize()
+	if len(raw) < nonceSize {
+		return "", fmt.Errorf("encrypted totp secret is shorter than the GCM nonce")
+	}
+
+	nonce, ciphertext := raw[:nonceSize], raw[nonceSize:]
+	plaintext, err := gcm.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return "", fmt.Errorf("decrypting totp secret: %w", err)
+	}
+
+	return string(plaintext), nil
+}
+
+// registerTOTPRekeyCommand wires `ovpn-admin totp rekey` into totpCmd.
+func registerTOTPRekeyCommand(totpCmd *kingpin.CmdClause) {
+	var dbPath, oldKeyFlag, newKeyFlag string
+
+	rekeyCmd := totpCmd.Command("rekey", "Re-encrypt all TOTP secrets under a new master key.")
+	rekeyCmd.Flag("db", "Path to the users sqlite database.").Required().StringVar(&dbPath)
+	rekeyCmd.Flag("old-key", "Current --totp-encryption-key value (\"none\" if unencrypted).").Required().StringVar(&oldKeyFlag)
+	rekeyCmd.Flag("new-key", "New --totp-encryption-key value to re-encrypt under.").Required().StringVar(&newKeyFlag)
+
+	rekeyCmd.Action(func(*kingpin.ParseContext) error {
+		return runTOTPRekey(dbPath, oldKeyFlag, newKeyFlag)
+	})
+}
+
+// runTOTPRekey decrypts every row in totp_secrets under oldKeyFlag and
+// re-encrypts it under newKeyFlag, inside a single transaction.
+func runTOTPRekey(dbPath, oldKeyFlag, newKeyFlag string) error {
+	oldKey, oldOptOut, err := LoadTOTPEncryptionKeyFlag(oldKeyFlag)
+	if err != nil {
+		return fmt.Errorf("old key: %w", err)
+	}
+	newKey, newOptOut, err := LoadTOTPEncryptionKeyFlag(newKeyFlag)
+	if err != nil {
+		return fmt.Errorf("new key: %w", err)
+	}
+	if newOptOut {
+		return fmt.Errorf("--new-key cannot be %q", totpEncryptionOptOut)
+	}
+	_ = oldOptOut // oldKey is already nil in that case; plaintext rows decrypt as-is
+
+	db, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query("SELECT username, secret FROM totp_secrets")
+	if err != nil {
+		return err
+	}
+
+	type row struct {
+		username, secret string
+	}
+	var all []row
+	for rows.Next() {
+		var r row
+		if err := rows.Scan(&r.username, &r.secret); err != nil {
+			rows.Close()
+			return err
+		}
+		all = append(all, r)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	stmt, err := tx.Prepare("UPDATE totp_secrets SET secret = ? WHERE username = ?")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, r := range all {
+		SetTOTPEncryptionKey(oldKey)
+		plaintext, err := decryptTOTPSecret(r.secret)
+		if err != nil {
+			return fmt.Errorf("decrypting secret for %q: %w", r.username, err)
+		}
+
+		SetTOTPEncryptionKey(newKey)
+		reencrypted, err := encryptTOTPSecret(plaintext)
+		if err != nil {
+			return fmt.Errorf("re-encrypting secret for %q: %w", r.username, err)
+		}
+
+		if _, err := stmt.Exec(reencrypted, r.username); err != nil {
+			return fmt.Errorf("updating secret for %q: %w", r.username, err)
+		}
+	}
+
+	return tx.Commit()
+}
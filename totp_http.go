@@ -0,0 +1,289 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// totpEnrollResponse is returned by POST /api/user/totp/enroll.
+type totpEnrollResponse struct {
+	Secret        string   `json:"secret"`
+	URL           string   `json:"url"`
+	QRCodePNGB64  string   `json:"qrcode_png_base64"`
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+// totpRecoveryCodesResponse is returned by POST
+// /api/user/totp/recovery-codes, which regenerates a user's recovery
+// codes.
+type totpRecoveryCodesResponse struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+// totpPasscodeRequest is the body accepted by the enable/disable/verify
+// endpoints: a passcode from the user's authenticator app, or a recovery
+// code where noted.
+type totpPasscodeRequest struct {
+	Passcode string `json:"passcode"`
+}
+
+// totpStatusResponse is returned by GET /api/user/totp/status.
+type totpStatusResponse struct {
+	Enrolled bool   `json:"enrolled"`
+	Enabled  bool   `json:"enabled"`
+	URL      string `json:"url,omitempty"`
+}
+
+// handleTOTPEnroll handles POST /api/user/totp/enroll for the logged-in
+// user, starting (or restarting) a pending enrollment.
+func (app *OvpnAdmin) handleTOTPEnroll(w http.ResponseWriter, r *http.Request) {
+	username := sessionUsername(r)
+	if username == "" {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	secret, url, qrCode, recoveryCodes, err := app.totpStore.EnrollTOTP(r.Context(), username)
+	if err != nil {
+		if errors.Is(err, ErrTOTPAlreadyEnabled) {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		log.WithError(err).Error("failed to enroll TOTP")
+		http.Error(w, "failed to enroll TOTP", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, totpEnrollResponse{Secret: secret, URL: url, QRCodePNGB64: qrCode, RecoveryCodes: recoveryCodes})
+}
+
+// handleTOTPEnable handles POST /api/user/totp/enable, confirming a pending
+// enrollment with a passcode from the user's authenticator app.
+func (app *OvpnAdmin) handleTOTPEnable(w http.ResponseWriter, r *http.Request) {
+	username := sessionUsername(r)
+	if username == "" {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req totpPasscodeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if err := app.totpStore.ConfirmTOTP(r.Context(), username, req.Passcode); err != nil {
+		log.WithError(err).Warn("failed to confirm TOTP enrollment")
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleTOTPDisable handles POST /api/user/totp/disable, requiring a valid
+// current passcode before removing the user's secret.
+func (app *OvpnAdmin) handleTOTPDisable(w http.ResponseWriter, r *http.Request) {
+	username := sessionUsername(r)
+	if username == "" {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req totpPasscodeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if err := app.totpStore.DisableTOTP(r.Context(), username, req.Passcode); err != nil {
+		log.WithError(err).Warn("failed to disable TOTP")
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleTOTPStatus handles GET /api/user/totp/status for the logged-in user.
+func (app *OvpnAdmin) handleTOTPStatus(w http.ResponseWriter, r *http.Request) {
+	username := sessionUsername(r)
+	if username == "" {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	status, err := app.totpStore.GetTOTPStatus(r.Context(), username)
+	if err != nil {
+		log.WithError(err).Error("failed to read TOTP status")
+		http.Error(w, "failed to read TOTP status", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, totpStatusResponse{Enrolled: status.Enrolled, Enabled: status.Enabled, URL: status.URL})
+}
+
+// handleTOTPVerify handles POST /api/user/totp/verify, used by the login
+// path to check a passcode against an already-enabled secret. If the
+// passcode is not a valid TOTP code, it is checked as one of the user's
+// unused recovery codes.
+func (app *OvpnAdmin) handleTOTPVerify(w http.ResponseWriter, r *http.Request) {
+	username := sessionUsername(r)
+	if username == "" {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req totpPasscodeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	ctx := r.Context()
+
+	secret, err := app.totpStore.getTOTPSecret(ctx, username)
+	if err != nil {
+		log.WithError(err).Error("failed to read TOTP secret")
+		http.Error(w, "failed to verify TOTP", http.StatusInternalServerError)
+		return
+	}
+	if secret == nil || !secret.Enabled {
+		http.Error(w, "invalid passcode", http.StatusForbidden)
+		return
+	}
+
+	ok, err := app.totpStore.verifyTOTP(ctx, secret, req.Passcode)
+	if err != nil {
+		log.WithError(err).Error("failed to verify TOTP passcode")
+		http.Error(w, "failed to verify TOTP", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		ok, err = app.totpStore.VerifyRecoveryCode(ctx, username, req.Passcode)
+		if err != nil {
+			log.WithError(err).Error("failed to verify TOTP recovery code")
+			http.Error(w, "failed to verify TOTP", http.StatusInternalServerError)
+			return
+		}
+	}
+	if !ok {
+		http.Error(w, "invalid passcode", http.StatusForbidden)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleTOTPRegenerateRecoveryCodes handles POST
+// /api/user/totp/recovery-codes, replacing the logged-in user's recovery
+// codes with a fresh batch.
+func (app *OvpnAdmin) handleTOTPRegenerateRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	username := sessionUsername(r)
+	if username == "" {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	codes, err := app.totpStore.RegenerateRecoveryCodes(r.Context(), username)
+	if err != nil {
+		log.WithError(err).Error("failed to regenerate TOTP recovery codes")
+		http.Error(w, "failed to regenerate recovery codes", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, totpRecoveryCodesResponse{RecoveryCodes: codes})
+}
+
+// adminUserTOTPResetPrefix and -Suffix bracket the username in a request
+// path of the form /api/admin/user/{username}/totp/reset. Go 1.21's
+// net/http.ServeMux has no {param} wildcard support, so the username is
+// extracted by hand in handleTOTPAdminReset.
+const (
+	adminUserTOTPResetPrefix = "/api/admin/user/"
+	adminUserTOTPResetSuffix = "/totp/reset"
+)
+
+// handleTOTPAdminReset handles POST /api/admin/user/{username}/totp/reset,
+// force-deleting a user's TOTP secret when their device is lost. It
+// rejects callers without an authenticated admin session; see
+// isAdminRequest.
+func (app *OvpnAdmin) handleTOTPAdminReset(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !isAdminRequest(r) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	trimmed := strings.TrimPrefix(r.URL.Path, adminUserTOTPResetPrefix)
+	username := strings.TrimSuffix(trimmed, adminUserTOTPResetSuffix)
+	if username == "" || username == trimmed {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+
+	if err := app.totpStore.deleteTOTPSecret(r.Context(), username); err != nil {
+		log.WithError(err).Error("failed to reset TOTP for user")
+		http.Error(w, "failed to reset TOTP", http.StatusInternalServerError)
+		return
+	}
+
+	log.WithField("username", username).Info("admin reset TOTP secret")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// writeJSON encodes v as the JSON response body.
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.WithError(err).Error("failed to write JSON response")
+	}
+}
+
+// sessionUsername returns the username of the authenticated caller, as set
+// by the existing session middleware on the request context. It returns ""
+// if the request carries no valid session.
+func sessionUsername(r *http.Request) string {
+	username, _ := r.Context().Value(usernameContextKey).(string)
+	return username
+}
+
+// isAdminRequest reports whether the request carries an authenticated admin
+// session, as set by the existing session middleware on the request
+// context. Used by handleTOTPAdminReset to gate itself.
+func isAdminRequest(r *http.Request) bool {
+	isAdmin, _ := r.Context().Value(adminContextKey).(bool)
+	return isAdmin
+}
+
+type contextKey string
+
+const (
+	usernameContextKey contextKey = "username"
+	adminContextKey    contextKey = "is_admin"
+)
+
+// OvpnAdmin is the shared application state wired into the HTTP router; it
+// is referenced here only for its pooled TOTP store.
+type OvpnAdmin struct {
+	totpStore *TOTPStore
+}
+
+// registerTOTPHandlers wires the TOTP self-service endpoints into mux,
+// alongside the rest of ovpn-admin's authenticated API.
+func (app *OvpnAdmin) registerTOTPHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("/api/user/totp/enroll", app.handleTOTPEnroll)
+	mux.HandleFunc("/api/user/totp/enable", app.handleTOTPEnable)
+	mux.HandleFunc("/api/user/totp/disable", app.handleTOTPDisable)
+	mux.HandleFunc("/api/user/totp/status", app.handleTOTPStatus)
+	mux.HandleFunc("/api/user/totp/verify", app.handleTOTPVerify)
+	mux.HandleFunc("/api/user/totp/recovery-codes", app.handleTOTPRegenerateRecoveryCodes)
+	mux.HandleFunc(adminUserTOTPResetPrefix, app.handleTOTPAdminReset)
+}
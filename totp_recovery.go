@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"math/big"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// recoveryCodeCount is the number of single-use recovery codes issued per
+// enrollment (and per regeneration).
+const recoveryCodeCount = 10
+
+// recoveryCodeAlphabet excludes visually ambiguous characters (0/O, 1/I/l)
+// so codes are easy to transcribe from a phone screen.
+const recoveryCodeAlphabet = "23456789ABCDEFGHJKLMNPQRSTUVWXYZ"
+
+// recoveryCodeLength is the number of characters per recovery code.
+const recoveryCodeLength = 10
+
+// RegenerateRecoveryCodes replaces username's recovery codes with a fresh
+// batch, returning the plaintext codes so they can be shown to the user
+// exactly once. Only bcrypt hashes are persisted.
+func (s *TOTPStore) RegenerateRecoveryCodes(ctx context.Context, username string) ([]string, error) {
+	codes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		code, err := generateRecoveryCode()
+		if err != nil {
+			return nil, err
+		}
+		codes[i] = code
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM totp_recovery_codes WHERE username = ?", username); err != nil {
+		return nil, err
+	}
+
+	stmt, err := tx.PrepareContext(ctx, "INSERT INTO totp_recovery_codes(username, code_hash, used_at) VALUES(?, ?, NULL)")
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	for _, code := range codes {
+		hash, err := bcrypt.GenerateFromPassword([]byte(code), bcrypt.DefaultCost)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := stmt.ExecContext(ctx, username, string(hash)); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return codes, nil
+}
+
+// VerifyRecoveryCode checks code against username's unused recovery codes
+// and, on a match, marks that code used so it cannot be replayed. It is the
+// fallback authentication path for a user who has lost their TOTP device.
+func (s *TOTPStore) VerifyRecoveryCode(ctx context.Context, username, code string) (bool, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT rowid, code_hash FROM totp_recovery_codes WHERE username = ? AND used_at IS NULL", username)
+	if err != nil {
+		return false, err
+	}
+
+	type candidate struct {
+		rowid    int64
+		codeHash string
+	}
+	var candidates []candidate
+	for rows.Next() {
+		var c candidate
+		if err := rows.Scan(&c.rowid, &c.codeHash); err != nil {
+			rows.Close()
+			return false, err
+		}
+		candidates = append(candidates, c)
+	}
+	if err := rows.Err(); err != nil {
+		return false, err
+	}
+	rows.Close()
+
+	for _, c := range candidates {
+		if bcrypt.CompareHashAndPassword([]byte(c.codeHash), []byte(code)) == nil {
+			_, err := s.db.ExecContext(ctx, "UPDATE totp_recovery_codes SET used_at = ? WHERE rowid = ?", time.Now().Unix(), c.rowid)
+			return err == nil, err
+		}
+	}
+
+	return false, nil
+}
+
+// generateRecoveryCode returns a random recovery code drawn from
+// recoveryCodeAlphabet, formatted in practice as a 10-character string.
+func generateRecoveryCode() (string, error) {
+	buf := make([]byte, recoveryCodeLength)
+	for i := range buf {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(recoveryCodeAlphabet))))
+		if err != nil {
+			return "", fmt.Errorf("generating recovery code: %w", err)
+		}
+		buf[i] = recoveryCodeAlphabet[n.Int64()]
+	}
+	return string(buf), nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/pquerna/otp/totp"
+)
+
+func newTOTPStoreForTest(t *testing.T) *TOTPStore {
+	t.Helper()
+
+	dbPath := filepath.Join(t.TempDir(), "users.db")
+	store, err := NewTOTPStore(dbPath)
+	if err != nil {
+		t.Fatalf("creating TOTP store: %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+
+	return store
+}
+
+func TestEnrollTOTP_RefusesToOverwriteAnEnabledSecret(t *testing.T) {
+	store := newTOTPStoreForTest(t)
+	ctx := context.Background()
+	const username = "alice"
+
+	secret, _, _, _, err := store.EnrollTOTP(ctx, username)
+	if err != nil {
+		t.Fatalf("initial enrollment: %v", err)
+	}
+
+	code, err := totp.GenerateCode(secret, time.Now())
+	if err != nil {
+		t.Fatalf("generating passcode: %v", err)
+	}
+
+	if err := store.ConfirmTOTP(ctx, username, code); err != nil {
+		t.Fatalf("confirming enrollment: %v", err)
+	}
+
+	// A second enrollment attempt must not be able to silently replace the
+	// now-enabled secret without proving possession of a passcode first.
+	if _, _, _, _, err := store.EnrollTOTP(ctx, username); err != ErrTOTPAlreadyEnabled {
+		t.Fatalf("expected ErrTOTPAlreadyEnabled, got: %v", err)
+	}
+
+	status, err := store.GetTOTPStatus(ctx, username)
+	if err != nil {
+		t.Fatalf("reading status: %v", err)
+	}
+	if !status.Enabled {
+		t.Fatal("expected TOTP to remain enabled after a rejected re-enrollment attempt")
+	}
+}
+
+func TestEnrollTOTP_AllowsReEnrollmentWhilePending(t *testing.T) {
+	store := newTOTPStoreForTest(t)
+	ctx := context.Background()
+	const username = "bob"
+
+	if _, _, _, _, err := store.EnrollTOTP(ctx, username); err != nil {
+		t.Fatalf("initial enrollment: %v", err)
+	}
+
+	// Never confirmed, so a second enroll call (e.g. a reloaded QR page)
+	// must be allowed to replace the pending secret.
+	if _, _, _, _, err := store.EnrollTOTP(ctx, username); err != nil {
+		t.Fatalf("expected re-enrollment of a pending (unconfirmed) secret to succeed, got: %v", err)
+	}
+}
+
+func TestNewTOTPStore_MigratesPreExistingTable(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "users.db")
+
+	db, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		t.Fatalf("opening db: %v", err)
+	}
+	if _, err := db.Exec(`CREATE TABLE totp_secrets (
+		username TEXT PRIMARY KEY,
+		secret TEXT NOT NULL,
+		url TEXT NOT NULL DEFAULT '',
+		enabled INTEGER NOT NULL DEFAULT 0
+	)`); err != nil {
+		t.Fatalf("creating pre-existing table: %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("closing db: %v", err)
+	}
+
+	store, err := NewTOTPStore(dbPath)
+	if err != nil {
+		t.Fatalf("expected NewTOTPStore to migrate a pre-existing totp_secrets table, got: %v", err)
+	}
+	store.Close()
+}
+
+func TestConfirmTOTP_RejectsInvalidPasscode(t *testing.T) {
+	store := newTOTPStoreForTest(t)
+	ctx := context.Background()
+	const username = "carol"
+
+	if _, _, _, _, err := store.EnrollTOTP(ctx, username); err != nil {
+		t.Fatalf("enrollment: %v", err)
+	}
+
+	if err := store.ConfirmTOTP(ctx, username, "000000"); err == nil {
+		t.Fatal("expected an incorrect passcode to be rejected")
+	}
+
+	status, err := store.GetTOTPStatus(ctx, username)
+	if err != nil {
+		t.Fatalf("reading status: %v", err)
+	}
+	if status.Enabled {
+		t.Fatal("TOTP must not become enabled from a failed confirmation")
+	}
+}